@@ -0,0 +1,52 @@
+package prom
+
+import (
+	"strings"
+
+	vegeta "github.com/tsenart/vegeta/v12/lib"
+)
+
+// ErrorClassifier maps a result's raw error string into a small, fixed taxonomy
+// suitable for use as a metric label. Using the raw error string directly as a label
+// (as vegeta's request_fail_count counter used to) causes unbounded cardinality, since
+// errors often embed the target host, port, or other per-request detail.
+type ErrorClassifier func(res *vegeta.Result) string
+
+// Built-in error classes returned by DefaultErrorClassifier.
+const (
+	ErrorClassNone              = ""
+	ErrorClassTimeout           = "timeout"
+	ErrorClassConnectionRefused = "connection_refused"
+	ErrorClassDNS               = "dns"
+	ErrorClassTLS               = "tls"
+	ErrorClassHTTPStatus        = "http_status"
+	ErrorClassOther             = "other"
+)
+
+// DefaultErrorClassifier maps res.Error into one of a small set of error classes by
+// matching common substrings produced by Go's net/http client. Results with an empty
+// Error but a status code outside [200,400) are classified as ErrorClassHTTPStatus,
+// matching vegeta's own attacker, which treats 3xx redirects as successful; anything
+// else that doesn't match a known pattern is ErrorClassOther.
+func DefaultErrorClassifier(res *vegeta.Result) string {
+	if res.Error == "" {
+		if res.Code < 200 || res.Code >= 400 {
+			return ErrorClassHTTPStatus
+		}
+		return ErrorClassNone
+	}
+
+	err := strings.ToLower(res.Error)
+	switch {
+	case strings.Contains(err, "timeout"), strings.Contains(err, "deadline exceeded"):
+		return ErrorClassTimeout
+	case strings.Contains(err, "connection refused"), strings.Contains(err, "econnrefused"):
+		return ErrorClassConnectionRefused
+	case strings.Contains(err, "no such host"), strings.Contains(err, "dns"):
+		return ErrorClassDNS
+	case strings.Contains(err, "tls"), strings.Contains(err, "x509"), strings.Contains(err, "certificate"):
+		return ErrorClassTLS
+	default:
+		return ErrorClassOther
+	}
+}
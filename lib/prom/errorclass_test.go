@@ -0,0 +1,83 @@
+package prom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	vegeta "github.com/tsenart/vegeta/v12/lib"
+)
+
+func TestDefaultErrorClassifier(t *testing.T) {
+	cases := []struct {
+		res  *vegeta.Result
+		want string
+	}{
+		{&vegeta.Result{Error: "Get \"http://x\": dial tcp: i/o timeout"}, ErrorClassTimeout},
+		{&vegeta.Result{Error: "dial tcp 127.0.0.1:80: connect: connection refused"}, ErrorClassConnectionRefused},
+		{&vegeta.Result{Error: "dial tcp: lookup x.invalid: no such host"}, ErrorClassDNS},
+		{&vegeta.Result{Error: "x509: certificate signed by unknown authority"}, ErrorClassTLS},
+		{&vegeta.Result{Error: "something else entirely"}, ErrorClassOther},
+		{&vegeta.Result{Error: "", Code: 500}, ErrorClassHTTPStatus},
+		{&vegeta.Result{Error: "", Code: 200}, ErrorClassNone},
+		{&vegeta.Result{Error: "", Code: 301}, ErrorClassNone},
+		{&vegeta.Result{Error: "", Code: 304}, ErrorClassNone},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, DefaultErrorClassifier(c.res), "error=%q code=%d", c.res.Error, c.res.Code)
+	}
+}
+
+func TestPromServerObserveIncrementsFailureCounters(t *testing.T) {
+	pm, err := NewPrometheusMetricsWithOptions(Options{DisableServer: true})
+	assert.Nil(t, err, "Error building Prometheus metrics. err=%s", err)
+	defer pm.Close()
+
+	r := &vegeta.Result{URL: "http://test.com/test1", Method: "GET", Code: 0, Error: "dial tcp: i/o timeout", Latency: 100 * time.Millisecond}
+	pm.Observe(r)
+	pm.Observe(r)
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(pm.requestFailCounter.WithLabelValues("GET", "http://test.com/test1", ErrorClassTimeout)))
+	assert.Equal(t, float64(2), testutil.ToFloat64(pm.requestErrorsCounter.WithLabelValues("GET", "http://test.com/test1", ErrorClassTimeout)))
+}
+
+func TestPromServerObserveCountsHTTPStatusFailures(t *testing.T) {
+	pm, err := NewPrometheusMetricsWithOptions(Options{DisableServer: true})
+	assert.Nil(t, err, "Error building Prometheus metrics. err=%s", err)
+	defer pm.Close()
+
+	// A steady 500 with no transport-level error: vegeta leaves Result.Error empty in
+	// this case, so the failure gate must not depend on it.
+	r := &vegeta.Result{URL: "http://test.com/test1", Method: "GET", Code: 500, Error: "", Latency: 100 * time.Millisecond}
+	pm.Observe(r)
+	pm.Observe(r)
+
+	assert.Equal(t, float64(2), testutil.ToFloat64(pm.requestFailCounter.WithLabelValues("GET", "http://test.com/test1", ErrorClassHTTPStatus)))
+	assert.Equal(t, float64(2), testutil.ToFloat64(pm.requestErrorsCounter.WithLabelValues("GET", "http://test.com/test1", ErrorClassHTTPStatus)))
+
+	// A successful 2xx with no error must not be counted as a failure.
+	ok := &vegeta.Result{URL: "http://test.com/test1", Method: "GET", Code: 200, Error: "", Latency: 100 * time.Millisecond}
+	pm.Observe(ok)
+	assert.Equal(t, float64(0), testutil.ToFloat64(pm.requestFailCounter.WithLabelValues("GET", "http://test.com/test1", ErrorClassNone)))
+
+	// vegeta's own attacker treats 3xx redirects as successful, so Observe must not
+	// count them as failures either.
+	redirect := &vegeta.Result{URL: "http://test.com/test1", Method: "GET", Code: 301, Error: "", Latency: 100 * time.Millisecond}
+	pm.Observe(redirect)
+	assert.Equal(t, float64(0), testutil.ToFloat64(pm.requestFailCounter.WithLabelValues("GET", "http://test.com/test1", ErrorClassNone)))
+}
+
+func TestPromServerObserveCustomErrorClassifier(t *testing.T) {
+	pm, err := NewPrometheusMetricsWithOptions(Options{
+		DisableServer:   true,
+		ErrorClassifier: func(res *vegeta.Result) string { return "custom" },
+	})
+	assert.Nil(t, err, "Error building Prometheus metrics. err=%s", err)
+	defer pm.Close()
+
+	r := &vegeta.Result{URL: "http://test.com/test1", Method: "GET", Error: "boom"}
+	pm.Observe(r)
+
+	assert.Equal(t, float64(1), testutil.ToFloat64(pm.requestErrorsCounter.WithLabelValues("GET", "http://test.com/test1", "custom")))
+}
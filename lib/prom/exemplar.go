@@ -0,0 +1,54 @@
+package prom
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	vegeta "github.com/tsenart/vegeta/v12/lib"
+)
+
+// ExemplarFromResult extracts exemplar labels (typically a trace or span ID) for a
+// given observed result. A nil return value means "no exemplar for this result",
+// which is always a safe choice. Prometheus only retains the exemplar that falls into
+// a given bucket, so this is best used to point at outliers, e.g. a trace ID for a
+// request that fell into the tail of the latency histogram.
+type ExemplarFromResult func(res *vegeta.Result) prometheus.Labels
+
+// TraceIDs is a side-channel linking an attack's sequence numbers (vegeta.Result.Seq)
+// to trace IDs the attacker observed on the outgoing request, e.g. a traceparent or
+// x-request-id header it set before firing the hit. Since vegeta.Result itself has no
+// room for caller-supplied metadata, attackers that want exemplars should call
+// Record with the sequence number of each request they send, and configure
+// Options.ExemplarFromResult to TraceIDs.Exemplar.
+type TraceIDs struct {
+	mu  sync.Mutex
+	ids map[uint64]string
+}
+
+// NewTraceIDs creates an empty TraceIDs side-channel.
+func NewTraceIDs() *TraceIDs {
+	return &TraceIDs{ids: make(map[uint64]string)}
+}
+
+// Record associates seq, a vegeta.Result.Seq value, with traceID. Call this when the
+// attacker issues the corresponding request, before the result is observed.
+func (t *TraceIDs) Record(seq uint64, traceID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ids[seq] = traceID
+}
+
+// Exemplar is an ExemplarFromResult that looks up the trace ID recorded for
+// res.Seq, returning a {"trace_id": ...} label set, or nil if none was recorded. The
+// entry is removed once read, so the side-channel does not grow unbounded over a long
+// running attack.
+func (t *TraceIDs) Exemplar(res *vegeta.Result) prometheus.Labels {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	traceID, ok := t.ids[res.Seq]
+	if !ok {
+		return nil
+	}
+	delete(t.ids, res.Seq)
+	return prometheus.Labels{"trace_id": traceID}
+}
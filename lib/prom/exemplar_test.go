@@ -0,0 +1,53 @@
+package prom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	vegeta "github.com/tsenart/vegeta/v12/lib"
+)
+
+func TestTraceIDsExemplar(t *testing.T) {
+	traceIDs := NewTraceIDs()
+	traceIDs.Record(42, "trace-abc")
+
+	r := &vegeta.Result{Seq: 42}
+	assert.Equal(t, prometheus.Labels{"trace_id": "trace-abc"}, traceIDs.Exemplar(r))
+	// Recorded once, so a second lookup for the same sequence number finds nothing.
+	assert.Nil(t, traceIDs.Exemplar(r))
+
+	assert.Nil(t, traceIDs.Exemplar(&vegeta.Result{Seq: 7}), "unrecorded sequence numbers have no exemplar")
+}
+
+func TestPromServerObserveWithExemplar(t *testing.T) {
+	traceIDs := NewTraceIDs()
+	pm, err := NewPrometheusMetricsWithOptions(Options{
+		DisableServer:      true,
+		ExemplarFromResult: traceIDs.Exemplar,
+	})
+	assert.Nil(t, err, "Error building Prometheus metrics. err=%s", err)
+	defer pm.Close()
+
+	traceIDs.Record(1, "trace-xyz")
+	pm.Observe(&vegeta.Result{URL: "http://test.com/test1", Method: "GET", Code: 200, Seq: 1, Latency: 100 * time.Millisecond})
+
+	mfs, err := pm.Gather()
+	assert.Nil(t, err, "Error gathering metrics. err=%s", err)
+
+	var found bool
+	for _, mf := range mfs {
+		if mf.GetName() != "request_seconds" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, b := range m.GetHistogram().GetBucket() {
+				if b.GetExemplar() != nil {
+					found = true
+				}
+			}
+		}
+	}
+	assert.True(t, found, "an exemplar should have been recorded on the request_seconds histogram")
+}
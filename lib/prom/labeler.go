@@ -0,0 +1,72 @@
+package prom
+
+import (
+	"regexp"
+	"strings"
+)
+
+// URLLabeler computes the value used for the "url" label on every metric observed by
+// PrometheusMetrics. Implementations should collapse high-cardinality path segments
+// (numeric IDs, UUIDs, ...) into a small, fixed set of route names, since the raw,
+// unmodified target URL can otherwise explode label cardinality and OOM Prometheus
+// during a real attack.
+type URLLabeler func(method, url string) string
+
+// numericSegment and uuidSegment match path segments that should be collapsed by
+// PathTemplateLabeler.
+var (
+	numericSegment = regexp.MustCompile(`^[0-9]+$`)
+	uuidSegment    = regexp.MustCompile(`(?i)^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+)
+
+// PathTemplateLabeler is a built-in URLLabeler that collapses numeric and UUID path
+// segments into ":id", e.g. "/users/123" and "/users/a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11"
+// both become "/users/:id". The query string, if any, is dropped entirely.
+func PathTemplateLabeler(method, url string) string {
+	if i := strings.IndexAny(url, "?#"); i != -1 {
+		url = url[:i]
+	}
+
+	segments := strings.Split(url, "/")
+	for i, seg := range segments {
+		if numericSegment.MatchString(seg) || uuidSegment.MatchString(seg) {
+			segments[i] = ":id"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// RegexLabeler builds a URLLabeler out of an ordered list of regular expressions and
+// their replacements, evaluated in order against the URL, e.g.
+//
+//	prom.RegexLabeler(
+//		prom.LabelRule{Pattern: regexp.MustCompile(`^/users/\d+$`), Replacement: "/users/:id"},
+//	)
+//
+// The first matching rule wins; if none match, the URL is returned unchanged.
+func RegexLabeler(rules ...LabelRule) URLLabeler {
+	return func(method, url string) string {
+		for _, rule := range rules {
+			if rule.Pattern.MatchString(url) {
+				return rule.Pattern.ReplaceAllString(url, rule.Replacement)
+			}
+		}
+		return url
+	}
+}
+
+// LabelRule is a single rule used by RegexLabeler: URLs matching Pattern are rewritten
+// via Pattern.ReplaceAllString(url, Replacement).
+type LabelRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// DropURLLabel is a URLLabeler that replaces the url label with a fixed route name,
+// for callers that would rather drop per-route cardinality entirely in favor of a
+// single caller-provided name (e.g. the name of the attack).
+func DropURLLabel(routeName string) URLLabeler {
+	return func(method, url string) string {
+		return routeName
+	}
+}
@@ -0,0 +1,62 @@
+package prom
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	vegeta "github.com/tsenart/vegeta/v12/lib"
+)
+
+func TestPathTemplateLabeler(t *testing.T) {
+	cases := map[string]string{
+		"/users/123":                                 "/users/:id",
+		"/users/124":                                 "/users/:id",
+		"/users/124?expand=profile":                  "/users/:id",
+		"/users/a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11": "/users/:id",
+		"/users/a0eebc99-9c0b-4ef8-bb6d-6bb9bd380a11/pet": "/users/:id/pet",
+		"/healthz": "/healthz",
+	}
+	for in, want := range cases {
+		assert.Equal(t, want, PathTemplateLabeler("GET", in), "input %s", in)
+	}
+}
+
+func TestRegexLabeler(t *testing.T) {
+	labeler := RegexLabeler(
+		LabelRule{Pattern: regexp.MustCompile(`^/users/\d+$`), Replacement: "/users/:id"},
+	)
+	assert.Equal(t, "/users/:id", labeler("GET", "/users/123"))
+	assert.Equal(t, "/other", labeler("GET", "/other"))
+}
+
+func TestDropURLLabel(t *testing.T) {
+	labeler := DropURLLabel("my-route")
+	assert.Equal(t, "my-route", labeler("GET", "/users/123"))
+	assert.Equal(t, "my-route", labeler("GET", "/users/124"))
+}
+
+func TestPromServerObserveBoundsURLCardinality(t *testing.T) {
+	pm, err := NewPrometheusMetricsWithOptions(Options{
+		DisableServer: true,
+		URLLabeler:    PathTemplateLabeler,
+	})
+	assert.Nil(t, err, "Error building Prometheus metrics. err=%s", err)
+	defer pm.Close()
+
+	for _, id := range []string{"1", "2", "3", "4", "5"} {
+		r := &vegeta.Result{URL: "http://test.com/users/" + id, Method: "GET", Code: 200, Latency: 100 * time.Millisecond}
+		pm.Observe(r)
+	}
+
+	mfs, err := pm.Gather()
+	assert.Nil(t, err, "Error gathering metrics. err=%s", err)
+
+	for _, mf := range mfs {
+		if mf.GetName() != "request_seconds" {
+			continue
+		}
+		assert.Len(t, mf.GetMetric(), 1, "all 5 distinct user IDs should collapse into a single series")
+	}
+}
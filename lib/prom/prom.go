@@ -6,22 +6,112 @@ import (
 	"net/http"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
 	vegeta "github.com/tsenart/vegeta/v12/lib"
 )
 
+// defaultLatencyBuckets are the request_seconds histogram buckets used when
+// Options.LatencyBuckets is not set.
+var defaultLatencyBuckets = []float64{0.1, 0.2, 0.5, 1.0, 2.0, 5.0, 10.0, 20, 50}
+
+// defaultSizeBuckets are the request_bytes_in/request_bytes_out histogram buckets used
+// when Options.SizeBuckets is not set.
+var defaultSizeBuckets = prometheus.ExponentialBuckets(64, 4, 8)
+
 //PrometheusMetrics vegeta metrics observer with exposition as Prometheus metrics endpoint
 type PrometheusMetrics struct {
-	requestSecondsHistogram *prometheus.HistogramVec
-	requestBytesInCounter   *prometheus.CounterVec
-	requestBytesOutCounter  *prometheus.CounterVec
-	requestFailCounter      *prometheus.CounterVec
-	srv                     http.Server
-	registry                *prometheus.Registry
+	requestSecondsHistogram  *prometheus.HistogramVec
+	requestBytesInCounter    *prometheus.CounterVec
+	requestBytesOutCounter   *prometheus.CounterVec
+	requestBytesInHistogram  *prometheus.HistogramVec
+	requestBytesOutHistogram *prometheus.HistogramVec
+	requestsInFlight         *prometheus.GaugeVec
+	requestFailCounter       *prometheus.CounterVec
+	requestErrorsCounter     *prometheus.CounterVec
+	srv                      *http.Server
+	registry                 *prometheus.Registry
+	urlLabeler               URLLabeler
+	exemplarFromResult       ExemplarFromResult
+	errorClassifier          ErrorClassifier
+
+	// PushOnClose, when true, makes Close perform one last push of the registry to
+	// the Pushgateway before shutting down. Only meaningful for instances created via
+	// NewPrometheusMetricsWithPush or NewPrometheusMetricsWithPushOptions, which set
+	// it to true by default.
+	PushOnClose bool
+	pusher      *push.Pusher
+	pushTicker  *time.Ticker
+	pushDone    chan struct{}
+	closeOnce   sync.Once
+}
+
+//Options configures a PrometheusMetrics instance. The zero value is usable and
+//reproduces the behaviour of NewPrometheusMetrics: a fresh, private registry and
+//an HTTP server bound to "0.0.0.0:8880".
+type Options struct {
+	// Registry is the prometheus.Registry metrics are registered into. If nil, a
+	// fresh registry is created, so concurrent PrometheusMetrics instances never
+	// collide the way they did when collectors were registered via promauto into
+	// the global default registry.
+	Registry *prometheus.Registry
+
+	// BindURL is the "[host]:[port]" the metrics HTTP server listens on. Ignored
+	// when DisableServer is true. Defaults to "0.0.0.0:8880".
+	BindURL string
+
+	// DisableServer skips starting the built-in HTTP server. Use this when the
+	// embedder intends to expose metrics itself, e.g. via its own
+	// promhttp.HandlerFor(pm, ...) mounted on an existing mux, or by scraping pm
+	// directly since PrometheusMetrics implements prometheus.Gatherer.
+	DisableServer bool
+
+	// Namespace and Subsystem are prepended to every metric name as
+	// "namespace_subsystem_name", following the usual prometheus.Opts convention. Use
+	// these to tell the metrics of concurrent attacks apart, or to fit vegeta's metrics
+	// into an existing naming scheme.
+	Namespace string
+	Subsystem string
+
+	// ConstLabels are attached to every metric exposed by this instance, e.g. to record
+	// which attack produced them. See prometheus.Opts.ConstLabels for caveats around
+	// their use.
+	ConstLabels prometheus.Labels
+
+	// LatencyBuckets overrides the request_seconds histogram buckets. Defaults to
+	// defaultLatencyBuckets ({0.1, ..., 50} seconds) when nil.
+	LatencyBuckets []float64
+
+	// SizeBuckets overrides the request_bytes_in/request_bytes_out histogram buckets.
+	// Defaults to defaultSizeBuckets when nil.
+	SizeBuckets []float64
+
+	// URLLabeler computes the "url" label value for every observed result. Defaults to
+	// the identity function (the raw, unmodified URL), which is fine for a handful of
+	// targets but can explode cardinality against targets with IDs in the path. Most
+	// callers attacking such targets should set this to PathTemplateLabeler, a
+	// RegexLabeler, or DropURLLabel.
+	URLLabeler URLLabeler
+
+	// ExemplarFromResult, when set, attaches an exemplar (typically a trace ID) to the
+	// request_seconds histogram observation for results where it returns a non-nil
+	// label set. This lets a p99 latency spike in Grafana jump straight to the
+	// corresponding trace in Tempo/Jaeger. See TraceIDs for a ready-made side-channel
+	// that keys trace IDs by a result's sequence number.
+	//
+	// Exemplars are only rendered by the built-in HTTP server when scraped in
+	// OpenMetrics format, which is always enabled on the server it starts.
+	ExemplarFromResult ExemplarFromResult
+
+	// ErrorClassifier maps a failed result's raw error string into a small, bounded
+	// error_class label value, used by both request_fail_count and
+	// request_errors_total. Defaults to DefaultErrorClassifier.
+	ErrorClassifier ErrorClassifier
 }
 
 //NewPrometheusMetrics same as NewPrometheusMetricsWithParams with default params:
@@ -31,8 +121,6 @@ func NewPrometheusMetrics() (*PrometheusMetrics, error) {
 
 // NewPrometheusMetricsWithParams start a new Prometheus observer instance for exposing
 // metrics to Prometheus Servers.
-// Only one PrometheusMetrics can be instantiated at a time because of the underlaying
-// mechanisms of promauto.
 // Some metrics are requests/s, bytes in/out/s and failures/s
 // Options are:
 //   - bindURL: "[host]:[port]/[path]" to bind the listening socket to
@@ -40,34 +128,59 @@ func NewPrometheusMetrics() (*PrometheusMetrics, error) {
 // during an "attack" you can call "curl http://127.0.0.0:8880" to see current metrics.
 // This endpoint can be configured in scrapper section of your Prometheus server.
 func NewPrometheusMetricsWithParams(bindURL string) (*PrometheusMetrics, error) {
+	return NewPrometheusMetricsWithOptions(Options{BindURL: bindURL})
+}
 
-	//parse bind url elements
-	re := regexp.MustCompile("(.+):([0-9]+)")
-	rr := re.FindAllStringSubmatch(bindURL, 3)
-	bindHost := ""
-	bindPort := 0
-	var err error
-	if len(rr) == 1 {
-		if len(rr[0]) == 3 {
-			bindHost = rr[0][1]
-			bindPort, err = strconv.Atoi(rr[0][2])
-			if err != nil {
-				return nil, err
-			}
-		}
+// NewPrometheusMetricsWithOptions starts a new Prometheus observer instance for exposing
+// metrics to Prometheus servers, configured via opts.
+//
+// Collectors are registered on opts.Registry (or a private registry created for this
+// instance when opts.Registry is nil) instead of the global default registry;
+// NewPrometheusMetricsWithParams and NewPrometheusMetrics always get such a private registry. This means several PrometheusMetrics can be instantiated
+// concurrently in the same process, and they can be unit-tested without racing each other
+// over shared global state.
+//
+// Setting opts.DisableServer skips starting the built-in HTTP server entirely; embedders
+// can instead scrape pm directly, since PrometheusMetrics implements prometheus.Gatherer.
+func NewPrometheusMetricsWithOptions(opts Options) (*PrometheusMetrics, error) {
+	registry := opts.Registry
+	if registry == nil {
+		registry = prometheus.NewRegistry()
+	}
+
+	urlLabeler := opts.URLLabeler
+	if urlLabeler == nil {
+		urlLabeler = func(method, url string) string { return url }
 	}
-	if bindHost == "" {
-		return nil, fmt.Errorf("Invalid bindURL %s. Must be in format '0.0.0.0:8880'", bindURL)
+
+	errorClassifier := opts.ErrorClassifier
+	if errorClassifier == nil {
+		errorClassifier = DefaultErrorClassifier
 	}
 
 	pm := &PrometheusMetrics{
-		registry: prometheus.NewRegistry(),
+		registry:           registry,
+		urlLabeler:         urlLabeler,
+		exemplarFromResult: opts.ExemplarFromResult,
+		errorClassifier:    errorClassifier,
+	}
+
+	latencyBuckets := opts.LatencyBuckets
+	if latencyBuckets == nil {
+		latencyBuckets = defaultLatencyBuckets
+	}
+	sizeBuckets := opts.SizeBuckets
+	if sizeBuckets == nil {
+		sizeBuckets = defaultSizeBuckets
 	}
 
 	pm.requestSecondsHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-		Name:    "request_seconds",
-		Help:    "Request latency",
-		Buckets: []float64{0.1, 0.2, 0.5, 1.0, 2.0, 5.0, 10.0, 20, 50},
+		Namespace:   opts.Namespace,
+		Subsystem:   opts.Subsystem,
+		Name:        "request_seconds",
+		Help:        "Request latency",
+		Buckets:     latencyBuckets,
+		ConstLabels: opts.ConstLabels,
 	}, []string{
 		"method",
 		"url",
@@ -75,9 +188,12 @@ func NewPrometheusMetricsWithParams(bindURL string) (*PrometheusMetrics, error)
 	})
 	pm.registry.MustRegister(pm.requestSecondsHistogram)
 
-	pm.requestBytesInCounter = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "request_bytes_in",
-		Help: "Bytes received from servers as response to requests",
+	pm.requestBytesInCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   opts.Namespace,
+		Subsystem:   opts.Subsystem,
+		Name:        "request_bytes_in",
+		Help:        "Bytes received from servers as response to requests",
+		ConstLabels: opts.ConstLabels,
 	}, []string{
 		"method",
 		"url",
@@ -85,9 +201,12 @@ func NewPrometheusMetricsWithParams(bindURL string) (*PrometheusMetrics, error)
 	})
 	pm.registry.MustRegister(pm.requestBytesInCounter)
 
-	pm.requestBytesOutCounter = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "request_bytes_out",
-		Help: "Bytes sent to servers during requests",
+	pm.requestBytesOutCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   opts.Namespace,
+		Subsystem:   opts.Subsystem,
+		Name:        "request_bytes_out",
+		Help:        "Bytes sent to servers during requests",
+		ConstLabels: opts.ConstLabels,
 	}, []string{
 		"method",
 		"url",
@@ -95,46 +214,198 @@ func NewPrometheusMetricsWithParams(bindURL string) (*PrometheusMetrics, error)
 	})
 	pm.registry.MustRegister(pm.requestBytesOutCounter)
 
-	pm.requestFailCounter = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "request_fail_count",
-		Help: "Internal failures that prevented a hit to the target server",
+	pm.requestBytesInHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   opts.Namespace,
+		Subsystem:   opts.Subsystem,
+		Name:        "request_bytes_in_histogram",
+		Help:        "Distribution of bytes received from servers as response to requests",
+		Buckets:     sizeBuckets,
+		ConstLabels: opts.ConstLabels,
 	}, []string{
 		"method",
 		"url",
-		"message",
+		"status",
+	})
+	pm.registry.MustRegister(pm.requestBytesInHistogram)
+
+	pm.requestBytesOutHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace:   opts.Namespace,
+		Subsystem:   opts.Subsystem,
+		Name:        "request_bytes_out_histogram",
+		Help:        "Distribution of bytes sent to servers during requests",
+		Buckets:     sizeBuckets,
+		ConstLabels: opts.ConstLabels,
+	}, []string{
+		"method",
+		"url",
+		"status",
+	})
+	pm.registry.MustRegister(pm.requestBytesOutHistogram)
+
+	pm.requestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace:   opts.Namespace,
+		Subsystem:   opts.Subsystem,
+		Name:        "requests_in_flight",
+		Help:        "Number of requests currently in flight",
+		ConstLabels: opts.ConstLabels,
+	}, []string{
+		"method",
+		"url",
+	})
+	pm.registry.MustRegister(pm.requestsInFlight)
+
+	pm.requestFailCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   opts.Namespace,
+		Subsystem:   opts.Subsystem,
+		Name:        "request_fail_count",
+		Help:        "Failed requests, either errors that prevented a hit to the target server or responses with a status outside [200,400)",
+		ConstLabels: opts.ConstLabels,
+	}, []string{
+		"method",
+		"url",
+		"error_class",
 	})
 	pm.registry.MustRegister(pm.requestFailCounter)
 
-	//setup prometheus metrics http server
-	pm.srv = http.Server{
-		Addr:    fmt.Sprintf("%s:%d", bindHost, bindPort),
-		Handler: promhttp.HandlerFor(pm.registry, promhttp.HandlerOpts{}),
-	}
+	pm.requestErrorsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace:   opts.Namespace,
+		Subsystem:   opts.Subsystem,
+		Name:        "request_errors_total",
+		Help:        "Total requests that did not succeed, partitioned by error class",
+		ConstLabels: opts.ConstLabels,
+	}, []string{
+		"method",
+		"url",
+		"error_class",
+	})
+	pm.registry.MustRegister(pm.requestErrorsCounter)
 
-	go func() {
-		pm.srv.ListenAndServe()
-	}()
+	if !opts.DisableServer {
+		bindURL := opts.BindURL
+		if bindURL == "" {
+			bindURL = "0.0.0.0:8880"
+		}
+
+		//parse bind url elements
+		re := regexp.MustCompile("(.+):([0-9]+)")
+		rr := re.FindAllStringSubmatch(bindURL, 3)
+		bindHost := ""
+		bindPort := 0
+		var err error
+		if len(rr) == 1 {
+			if len(rr[0]) == 3 {
+				bindHost = rr[0][1]
+				bindPort, err = strconv.Atoi(rr[0][2])
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if bindHost == "" {
+			return nil, fmt.Errorf("Invalid bindURL %s. Must be in format '0.0.0.0:8880'", bindURL)
+		}
+
+		//setup prometheus metrics http server
+		pm.srv = &http.Server{
+			Addr:    fmt.Sprintf("%s:%d", bindHost, bindPort),
+			Handler: promhttp.HandlerFor(pm.registry, promhttp.HandlerOpts{EnableOpenMetrics: true}),
+		}
+
+		go func() {
+			pm.srv.ListenAndServe()
+		}()
+	}
 
 	return pm, nil
 }
 
-//Close shutdown http server exposing Prometheus metrics and unregister
-//all prometheus collectors
+//Gather implements prometheus.Gatherer by delegating to the internal registry. This lets
+//embedders scrape a PrometheusMetrics instance directly, e.g. via their own
+//promhttp.HandlerFor(pm, ...), without needing the built-in HTTP server.
+func (pm *PrometheusMetrics) Gather() ([]*dto.MetricFamily, error) {
+	return pm.registry.Gather()
+}
+
+//Close shutdown http server exposing Prometheus metrics, if one was started, stops
+//the periodic Pushgateway push, if any, pushes the final batch of metrics if
+//PushOnClose is set, and unregisters all prometheus collectors. Close is safe to call
+//more than once; calls after the first are a no-op and return nil.
 func (pm *PrometheusMetrics) Close() error {
-	prometheus.Unregister(pm.requestSecondsHistogram)
-	prometheus.Unregister(pm.requestBytesInCounter)
-	prometheus.Unregister(pm.requestBytesOutCounter)
-	prometheus.Unregister(pm.requestFailCounter)
-	return pm.srv.Shutdown(context.Background())
+	var err error
+	pm.closeOnce.Do(func() {
+		err = pm.close()
+	})
+	return err
+}
+
+// close does the actual work of Close. It is only ever run once, via closeOnce, since
+// stopping pushTicker and closing pushDone a second time would panic.
+func (pm *PrometheusMetrics) close() error {
+	if pm.pushTicker != nil {
+		pm.pushTicker.Stop()
+		close(pm.pushDone)
+	}
+
+	var pushErr error
+	if pm.pusher != nil && pm.PushOnClose {
+		pushErr = pm.pusher.Push()
+	}
+
+	pm.registry.Unregister(pm.requestSecondsHistogram)
+	pm.registry.Unregister(pm.requestBytesInCounter)
+	pm.registry.Unregister(pm.requestBytesOutCounter)
+	pm.registry.Unregister(pm.requestBytesInHistogram)
+	pm.registry.Unregister(pm.requestBytesOutHistogram)
+	pm.registry.Unregister(pm.requestsInFlight)
+	pm.registry.Unregister(pm.requestFailCounter)
+	pm.registry.Unregister(pm.requestErrorsCounter)
+
+	if pm.srv != nil {
+		if err := pm.srv.Shutdown(context.Background()); err != nil {
+			return err
+		}
+	}
+
+	return pushErr
+}
+
+//BeginRequest marks a request as in flight, incrementing requests_in_flight for the
+//given method/url pair. Callers that want in-flight visibility around the attacker's
+//round trip (rather than just the final Observe) should call BeginRequest before
+//issuing the request and EndRequest once it completes. url is passed through the
+//configured URLLabeler before being used as a label value.
+func (pm *PrometheusMetrics) BeginRequest(method, url string) {
+	pm.requestsInFlight.WithLabelValues(method, pm.urlLabeler(method, url)).Inc()
+}
+
+//EndRequest marks a request started with BeginRequest as completed, decrementing
+//requests_in_flight for the given method/url pair.
+func (pm *PrometheusMetrics) EndRequest(method, url string) {
+	pm.requestsInFlight.WithLabelValues(method, pm.urlLabeler(method, url)).Dec()
 }
 
 //Observe register metrics about hit results
 func (pm *PrometheusMetrics) Observe(res *vegeta.Result) {
 	code := strconv.FormatUint(uint64(res.Code), 10)
-	pm.requestBytesInCounter.WithLabelValues(res.Method, res.URL, code).Add(float64(res.BytesIn))
-	pm.requestBytesOutCounter.WithLabelValues(res.Method, res.URL, code).Add(float64(res.BytesOut))
-	pm.requestSecondsHistogram.WithLabelValues(res.Method, res.URL, code).Observe(float64(res.Latency) / float64(time.Second))
-	if res.Error != "" {
-		pm.requestFailCounter.WithLabelValues(res.Method, res.URL, res.Error)
+	url := pm.urlLabeler(res.Method, res.URL)
+	pm.requestBytesInCounter.WithLabelValues(res.Method, url, code).Add(float64(res.BytesIn))
+	pm.requestBytesOutCounter.WithLabelValues(res.Method, url, code).Add(float64(res.BytesOut))
+	pm.requestBytesInHistogram.WithLabelValues(res.Method, url, code).Observe(float64(res.BytesIn))
+	pm.requestBytesOutHistogram.WithLabelValues(res.Method, url, code).Observe(float64(res.BytesOut))
+	latency := float64(res.Latency) / float64(time.Second)
+	latencyObserver := pm.requestSecondsHistogram.WithLabelValues(res.Method, url, code)
+	var exemplar prometheus.Labels
+	if pm.exemplarFromResult != nil {
+		exemplar = pm.exemplarFromResult(res)
+	}
+	if exemplar != nil {
+		latencyObserver.(prometheus.ExemplarObserver).ObserveWithExemplar(latency, exemplar)
+	} else {
+		latencyObserver.Observe(latency)
+	}
+	if res.Error != "" || res.Code < 200 || res.Code >= 400 {
+		errorClass := pm.errorClassifier(res)
+		pm.requestFailCounter.WithLabelValues(res.Method, url, errorClass).Inc()
+		pm.requestErrorsCounter.WithLabelValues(res.Method, url, errorClass).Inc()
 	}
 }
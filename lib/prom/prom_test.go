@@ -6,6 +6,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	vegeta "github.com/tsenart/vegeta/v12/lib"
 )
@@ -34,6 +36,71 @@ func TestPromServerBasic2(t *testing.T) {
 	assert.Nil(t, err, "Error stopping Prometheus http server. err=%s", err)
 }
 
+func TestPromServerWithOptionsPrivateRegistry(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	pm, err := NewPrometheusMetricsWithOptions(Options{Registry: registry, DisableServer: true})
+	assert.Nil(t, err, "Error building Prometheus metrics. err=%s", err)
+	defer pm.Close()
+
+	r := &vegeta.Result{URL: "http://test.com/test1", Method: "GET", Code: 200, Latency: 100 * time.Millisecond}
+	pm.Observe(r)
+
+	mfs, err := pm.Gather()
+	assert.Nil(t, err, "Error gathering metrics. err=%s", err)
+	assert.NotEmpty(t, mfs, "Gather should return the registered metric families")
+
+	// The same metrics must also be visible on the caller-supplied registry.
+	mfs, err = registry.Gather()
+	assert.Nil(t, err, "Error gathering metrics from caller registry. err=%s", err)
+	assert.NotEmpty(t, mfs, "Caller registry should observe the same metrics")
+}
+
+func TestPromServerDisableServer(t *testing.T) {
+	pm, err := NewPrometheusMetricsWithOptions(Options{DisableServer: true})
+	assert.Nil(t, err, "Error building Prometheus metrics. err=%s", err)
+	_, err = http.Get("http://localhost:8880")
+	assert.NotNil(t, err, "No HTTP server should be listening when DisableServer is set")
+	assert.Nil(t, pm.Close())
+}
+
+func TestPromServerWithNamespaceAndConstLabels(t *testing.T) {
+	pm, err := NewPrometheusMetricsWithOptions(Options{
+		DisableServer: true,
+		Namespace:     "vegeta",
+		Subsystem:     "attack",
+		ConstLabels:   prometheus.Labels{"attack": "smoke-test"},
+	})
+	assert.Nil(t, err, "Error building Prometheus metrics. err=%s", err)
+	defer pm.Close()
+
+	r := &vegeta.Result{URL: "http://test.com/test1", Method: "GET", Code: 200, Latency: 100 * time.Millisecond, BytesIn: 10, BytesOut: 5}
+	pm.Observe(r)
+	pm.BeginRequest(r.Method, r.URL)
+	defer pm.EndRequest(r.Method, r.URL)
+
+	mfs, err := pm.Gather()
+	assert.Nil(t, err, "Error gathering metrics. err=%s", err)
+
+	names := map[string]bool{}
+	for _, mf := range mfs {
+		names[mf.GetName()] = true
+	}
+	assert.True(t, names["vegeta_attack_request_seconds"], "metric names should be namespaced")
+	assert.True(t, names["vegeta_attack_requests_in_flight"], "requests_in_flight should be registered")
+	assert.True(t, names["vegeta_attack_request_bytes_in_histogram"], "request_bytes_in_histogram should be registered")
+}
+
+func TestPromServerInFlightGauge(t *testing.T) {
+	pm, err := NewPrometheusMetricsWithOptions(Options{DisableServer: true})
+	assert.Nil(t, err, "Error building Prometheus metrics. err=%s", err)
+	defer pm.Close()
+
+	pm.BeginRequest("GET", "http://test.com/test1")
+	assert.Equal(t, float64(1), testutil.ToFloat64(pm.requestsInFlight.WithLabelValues("GET", "http://test.com/test1")))
+	pm.EndRequest("GET", "http://test.com/test1")
+	assert.Equal(t, float64(0), testutil.ToFloat64(pm.requestsInFlight.WithLabelValues("GET", "http://test.com/test1")))
+}
+
 func TestPromServerObserve(t *testing.T) {
 	pm, err := NewPrometheusMetrics()
 	assert.Nil(t, err, "Error launching Prometheus http server. err=%s", err)
@@ -0,0 +1,64 @@
+package prom
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// NewPrometheusMetricsWithPush builds a PrometheusMetrics that periodically pushes its
+// registry to a Prometheus Pushgateway instead of exposing a pull-based scrape
+// endpoint. This suits short-lived attacks, often run in CI, where a scrape endpoint
+// racing against process exit loses the tail of metrics.
+//
+// pushURL is the Pushgateway base URL (e.g. "http://pushgateway:9091"), jobName is the
+// Pushgateway "job" grouping key, and grouping holds any additional grouping key
+// labels needed to keep concurrent attacks from overwriting each other's metrics
+// (e.g. map[string]string{"instance": "attack-1"}). interval controls how often the
+// registry is pushed while the attack runs; pass 0 to disable periodic pushing and
+// rely solely on the push done by Close (see PushOnClose).
+//
+// The returned PrometheusMetrics has PushOnClose set to true, so Close always performs
+// one last push before shutting down, ensuring the final batch of metrics observed
+// before the attack ended is not lost. Set PushOnClose to false to opt out, e.g. if
+// the periodic push already covers it and a final push is undesirable.
+func NewPrometheusMetricsWithPush(pushURL, jobName string, grouping map[string]string, interval time.Duration) (*PrometheusMetrics, error) {
+	return NewPrometheusMetricsWithPushOptions(Options{}, pushURL, jobName, grouping, interval)
+}
+
+// NewPrometheusMetricsWithPushOptions is like NewPrometheusMetricsWithPush but allows
+// the rest of PrometheusMetrics to be configured via opts, e.g. to set Namespace,
+// ConstLabels, or a URLLabeler. opts.DisableServer is forced to true: a Pushgateway
+// setup has no pull-based scrape endpoint of its own.
+func NewPrometheusMetricsWithPushOptions(opts Options, pushURL, jobName string, grouping map[string]string, interval time.Duration) (*PrometheusMetrics, error) {
+	opts.DisableServer = true
+
+	pm, err := NewPrometheusMetricsWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	pusher := push.New(pushURL, jobName).Gatherer(pm)
+	for name, value := range grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+	pm.pusher = pusher
+	pm.PushOnClose = true
+
+	if interval > 0 {
+		pm.pushTicker = time.NewTicker(interval)
+		pm.pushDone = make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-pm.pushTicker.C:
+					pm.pusher.Push()
+				case <-pm.pushDone:
+					return
+				}
+			}
+		}()
+	}
+
+	return pm, nil
+}
@@ -0,0 +1,83 @@
+package prom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	vegeta "github.com/tsenart/vegeta/v12/lib"
+)
+
+func TestPromServerPushOnClose(t *testing.T) {
+	var pushes int32
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&pushes, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	pm, err := NewPrometheusMetricsWithPush(gateway.URL, "vegeta-attack", map[string]string{"instance": "test"}, 0)
+	assert.Nil(t, err, "Error building Prometheus metrics. err=%s", err)
+
+	pm.Observe(&vegeta.Result{URL: "http://test.com/test1", Method: "GET", Code: 200, Latency: 100 * time.Millisecond})
+
+	assert.Nil(t, pm.Close())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&pushes), "Close should push exactly once when PushOnClose is set and no periodic interval is configured")
+}
+
+func TestPromServerPushInterval(t *testing.T) {
+	var pushes int32
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&pushes, 1)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	pm, err := NewPrometheusMetricsWithPush(gateway.URL, "vegeta-attack", nil, 10*time.Millisecond)
+	assert.Nil(t, err, "Error building Prometheus metrics. err=%s", err)
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, pm.Close())
+	assert.True(t, atomic.LoadInt32(&pushes) >= 2, "periodic push should have fired at least once before Close's final push")
+}
+
+func TestPromServerPushIntervalCloseIsIdempotent(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	pm, err := NewPrometheusMetricsWithPush(gateway.URL, "vegeta-attack", nil, 10*time.Millisecond)
+	assert.Nil(t, err, "Error building Prometheus metrics. err=%s", err)
+
+	assert.NotPanics(t, func() {
+		assert.Nil(t, pm.Close())
+		assert.Nil(t, pm.Close())
+	}, "a second Close on a periodic-push instance must not panic")
+}
+
+func TestPromServerCloseUnregistersEvenWhenPushFails(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	gateway.Close() // closed before use, so any push against it fails
+
+	registry := prometheus.NewRegistry()
+	pm, err := NewPrometheusMetricsWithPushOptions(Options{Registry: registry}, gateway.URL, "vegeta-attack", nil, 0)
+	assert.Nil(t, err, "Error building Prometheus metrics. err=%s", err)
+
+	err = pm.Close()
+	assert.NotNil(t, err, "Close should surface the Pushgateway error")
+
+	// A second instance reusing the same registry must not panic on duplicate
+	// collector registration left behind by a failed Close.
+	assert.NotPanics(t, func() {
+		pm2, err := NewPrometheusMetricsWithOptions(Options{Registry: registry, DisableServer: true})
+		assert.Nil(t, err, "Error building Prometheus metrics. err=%s", err)
+		assert.Nil(t, pm2.Close())
+	})
+}